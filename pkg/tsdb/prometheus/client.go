@@ -0,0 +1,173 @@
+package prometheus
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// epQueryRange is the Prometheus HTTP API path apiv1.API itself queries;
+// statsAwareAPI has to hit it directly since apiv1.API doesn't let callers
+// request stats=all.
+const epQueryRange = "/api/v1/query_range"
+
+// newAPIClient builds a Prometheus apiv1.API client for address, wrapping
+// transport so queries are sent according to settings.HTTPMethod. The
+// returned client also implements statsCapable, so PrometheusQuery.Stats
+// works against a real Prometheus server.
+func newAPIClient(address string, transport http.RoundTripper, settings DatasourceSettings) (apiv1.API, error) {
+	method := settings.HTTPMethod
+	if method == "" {
+		method = HTTPMethodAuto
+	}
+
+	cfg := api.Config{
+		Address:      address,
+		RoundTripper: newPostWithGetFallbackRoundTripper(transport, method),
+	}
+
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsAwareAPI{API: apiv1.NewAPI(client), client: client}, nil
+}
+
+// statsAwareAPI augments the stock client_golang apiv1.API with
+// QueryRangeStats. apiv1.API never sends stats=all and never surfaces the
+// resulting stats block, so this talks to client directly and decodes the
+// response itself, reusing the same RoundTripper (and so the same
+// GET/POST/AUTO handling) as every other query.
+type statsAwareAPI struct {
+	apiv1.API
+	client api.Client
+}
+
+func (a *statsAwareAPI) QueryRangeStats(ctx context.Context, query string, r apiv1.Range) (model.Value, *PrometheusStats, apiv1.Warnings, error) {
+	u := a.client.URL(epQueryRange, nil)
+
+	q := u.Query()
+	q.Set("query", query)
+	q.Set("start", formatTime(r.Start))
+	q.Set("end", formatTime(r.End))
+	q.Set("step", formatDuration(r.Step))
+	q.Set("stats", "all")
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	_, body, err := a.client.Do(ctx, req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return parseRangeQueryStatsResponse(body)
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.Unix())+float64(t.Nanosecond())/1e9, 'f', -1, 64)
+}
+
+func formatDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// postWithGetFallbackRoundTripper rewrites Prometheus API requests, which
+// client_golang always issues as GET with parameters in the query string,
+// into POST requests with a form-encoded body. Long PromQL expressions
+// frequently exceed the 8KiB URL limit of intermediary proxies, causing 414
+// responses; POST avoids that. If the upstream doesn't support POST (405 or
+// 501), it transparently falls back to the original GET request and
+// remembers that outcome so later requests on this datasource skip straight
+// to GET.
+type postWithGetFallbackRoundTripper struct {
+	next   http.RoundTripper
+	method HTTPMethod
+
+	mu         sync.Mutex
+	useGetOnly bool
+}
+
+func newPostWithGetFallbackRoundTripper(next http.RoundTripper, method HTTPMethod) http.RoundTripper {
+	return &postWithGetFallbackRoundTripper{next: next, method: method}
+}
+
+func (rt *postWithGetFallbackRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch rt.method {
+	case HTTPMethodGet:
+		return rt.next.RoundTrip(req)
+	case HTTPMethodPost:
+		postReq, err := asPostRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		return rt.next.RoundTrip(postReq)
+	default:
+		return rt.roundTripAuto(req)
+	}
+}
+
+func (rt *postWithGetFallbackRoundTripper) roundTripAuto(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	useGetOnly := rt.useGetOnly
+	rt.mu.Unlock()
+
+	if useGetOnly {
+		return rt.next.RoundTrip(req)
+	}
+
+	postReq, err := asPostRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := rt.next.RoundTrip(postReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		rt.mu.Lock()
+		rt.useGetOnly = true
+		rt.mu.Unlock()
+
+		return rt.next.RoundTrip(req)
+	}
+
+	return resp, nil
+}
+
+// asPostRequest turns a GET request whose Prometheus API parameters are
+// encoded in the URL's query string into an equivalent POST request with
+// those same parameters moved into an application/x-www-form-urlencoded
+// body.
+func asPostRequest(req *http.Request) (*http.Request, error) {
+	body := req.URL.Query().Encode()
+
+	postReq := req.Clone(req.Context())
+	postReq.Method = http.MethodPost
+	postReq.URL = &url.URL{
+		Scheme: req.URL.Scheme,
+		Host:   req.URL.Host,
+		Path:   req.URL.Path,
+	}
+	postReq.Body = ioutil.NopCloser(strings.NewReader(body))
+	postReq.ContentLength = int64(len(body))
+	postReq.Header = req.Header.Clone()
+	postReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return postReq, nil
+}
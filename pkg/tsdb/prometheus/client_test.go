@@ -0,0 +1,205 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/require"
+)
+
+const matrixResponseJSON = `
+{
+	"status": "success",
+	"data": {
+		"resultType": "matrix",
+		"result": [
+			{
+				"metric": { "__name__": "go_goroutines" },
+				"values": [[1641889530, "21"]]
+			}
+		]
+	}
+}
+`
+
+// recordingRoundTripper remembers every request it saw and, when
+// rejectPost is set, responds 405 to POST so fallback-to-GET can be
+// exercised, mirroring the MockedRoundTripper used for the JSON parsing
+// tests in this package.
+type recordingRoundTripper struct {
+	requests   []*http.Request
+	rejectPost bool
+	// response overrides the canned matrixResponseJSON body, for tests that
+	// need a specific payload (e.g. one carrying a stats block).
+	response []byte
+}
+
+func (rt *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// http.Client.Do consumes the request's body; snapshot it for assertions.
+	recorded := req.Clone(req.Context())
+	if req.Body != nil {
+		b, _ := ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		recorded.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+	rt.requests = append(rt.requests, recorded)
+
+	if rt.rejectPost && req.Method == http.MethodPost {
+		return &http.Response{
+			StatusCode: http.StatusMethodNotAllowed,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}, nil
+	}
+
+	body := rt.response
+	if body == nil {
+		body = []byte(matrixResponseJSON)
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+func bodyOf(t *testing.T, req *http.Request) url.Values {
+	t.Helper()
+	b, err := ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	values, err := url.ParseQuery(string(b))
+	require.NoError(t, err)
+	return values
+}
+
+func TestPostWithGetFallbackRoundTripper(t *testing.T) {
+	start := time.Unix(1641889530, 0)
+
+	t.Run("GET sends a plain GET request", func(t *testing.T) {
+		recorder := &recordingRoundTripper{}
+		client, err := newAPIClient("http://localhost:9999", recorder, DatasourceSettings{HTTPMethod: HTTPMethodGet})
+		require.NoError(t, err)
+
+		_, _, err = client.QueryRange(context.Background(), "up", apiv1.Range{Start: start, End: start.Add(time.Second), Step: time.Second})
+		require.NoError(t, err)
+
+		require.Len(t, recorder.requests, 1)
+		require.Equal(t, http.MethodGet, recorder.requests[0].Method)
+	})
+
+	t.Run("POST sends a form-encoded POST request for QueryRange", func(t *testing.T) {
+		recorder := &recordingRoundTripper{}
+		client, err := newAPIClient("http://localhost:9999", recorder, DatasourceSettings{HTTPMethod: HTTPMethodPost})
+		require.NoError(t, err)
+
+		_, _, err = client.QueryRange(context.Background(), "up", apiv1.Range{Start: start, End: start.Add(time.Second), Step: time.Second})
+		require.NoError(t, err)
+
+		require.Len(t, recorder.requests, 1)
+		req := recorder.requests[0]
+		require.Equal(t, http.MethodPost, req.Method)
+		require.Equal(t, "application/x-www-form-urlencoded", req.Header.Get("Content-Type"))
+		require.Equal(t, "up", bodyOf(t, req).Get("query"))
+	})
+
+	t.Run("POST sends a form-encoded POST request for Query", func(t *testing.T) {
+		recorder := &recordingRoundTripper{}
+		client, err := newAPIClient("http://localhost:9999", recorder, DatasourceSettings{HTTPMethod: HTTPMethodPost})
+		require.NoError(t, err)
+
+		_, _, err = client.Query(context.Background(), "up", start)
+		require.NoError(t, err)
+
+		require.Len(t, recorder.requests, 1)
+		req := recorder.requests[0]
+		require.Equal(t, http.MethodPost, req.Method)
+		require.Equal(t, "up", bodyOf(t, req).Get("query"))
+	})
+
+	t.Run("AUTO tries POST first and uses it when it succeeds", func(t *testing.T) {
+		recorder := &recordingRoundTripper{}
+		client, err := newAPIClient("http://localhost:9999", recorder, DatasourceSettings{HTTPMethod: HTTPMethodAuto})
+		require.NoError(t, err)
+
+		_, _, err = client.QueryRange(context.Background(), "up", apiv1.Range{Start: start, End: start.Add(time.Second), Step: time.Second})
+		require.NoError(t, err)
+
+		require.Len(t, recorder.requests, 1)
+		require.Equal(t, http.MethodPost, recorder.requests[0].Method)
+	})
+
+	t.Run("AUTO falls back to GET when POST is rejected, and remembers it", func(t *testing.T) {
+		recorder := &recordingRoundTripper{rejectPost: true}
+		client, err := newAPIClient("http://localhost:9999", recorder, DatasourceSettings{HTTPMethod: HTTPMethodAuto})
+		require.NoError(t, err)
+
+		r := apiv1.Range{Start: start, End: start.Add(time.Second), Step: time.Second}
+
+		_, _, err = client.QueryRange(context.Background(), "up", r)
+		require.NoError(t, err)
+		require.Len(t, recorder.requests, 2)
+		require.Equal(t, http.MethodPost, recorder.requests[0].Method)
+		require.Equal(t, http.MethodGet, recorder.requests[1].Method)
+
+		// the next query on the same client should skip the POST probe entirely.
+		_, _, err = client.QueryRange(context.Background(), "up", r)
+		require.NoError(t, err)
+		require.Len(t, recorder.requests, 3)
+		require.Equal(t, http.MethodGet, recorder.requests[2].Method)
+	})
+}
+
+// TestNewAPIClient_Stats exercises the client actually constructed in
+// production (newAPIClient), not a hand-rolled statsCapable stub, to make
+// sure PrometheusQuery.Stats does something against a real server.
+func TestNewAPIClient_Stats(t *testing.T) {
+	start := time.Unix(1641889530, 0)
+
+	response := `
+	{
+		"status": "success",
+		"data": {
+			"resultType": "matrix",
+			"result": [
+				{ "metric": { "__name__": "go_goroutines" }, "values": [[1641889530, "21"]] }
+			],
+			"stats": {
+				"samplesTotal": 10,
+				"peakSamples": 5
+			}
+		}
+	}
+	`
+
+	recorder := &recordingRoundTripper{response: []byte(response)}
+	client, err := newAPIClient("http://localhost:9999", recorder, DatasourceSettings{HTTPMethod: HTTPMethodPost})
+	require.NoError(t, err)
+
+	query := PrometheusQuery{
+		RefId:      "A",
+		RangeQuery: true,
+		Start:      start,
+		End:        start.Add(time.Second),
+		Step:       time.Second,
+		Stats:      true,
+	}
+
+	result, err := runQueries(context.Background(), client, []*PrometheusQuery{&query}, nil)
+	require.NoError(t, err)
+
+	dr := result.Responses["A"]
+	require.NoError(t, dr.Error)
+
+	require.Len(t, recorder.requests, 1)
+	require.Equal(t, "all", bodyOf(t, recorder.requests[0]).Get("stats"))
+
+	require.NotNil(t, dr.Frames[0].Meta)
+	require.Equal(t, map[string]interface{}{
+		prometheusStatsMetaKey: &PrometheusStats{SamplesTotal: 10, PeakSamples: 5},
+	}, dr.Frames[0].Meta.Custom)
+}
@@ -0,0 +1,175 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// defaultUptimeMetric is used to probe a target's uptime when
+// PrometheusQuery.UptimeMetric isn't set and no "job" label can be derived
+// from the primary query's results.
+const defaultUptimeMetric = "up"
+
+// detectGaps re-queries Prometheus for the series' uptime metric over the
+// same Start/End/Step window as query and annotates frames wherever the
+// primary query has a hole at a step where the target also appears to have
+// been down. primaryFrames is the result of valueToDataFrames for this
+// query, before any other frames (e.g. a stats "_samples" frame, which has
+// one entry per evaluation step regardless of the primary series having
+// data there) were spliced into frames - holes must be judged against it
+// alone, or those frames mask real gaps. It never fails the primary query:
+// any problem fetching or parsing the uptime series degrades to a warning
+// notice and an "assume up" series instead of an error.
+func detectGaps(ctx context.Context, client apiv1.API, query *PrometheusQuery, frames, primaryFrames data.Frames) data.Frames {
+	if !query.RangeQuery || len(primaryFrames) == 0 || query.Step <= 0 {
+		return frames
+	}
+
+	expr := uptimeExpr(query, primaryFrames)
+
+	r := apiv1.Range{Start: query.Start, End: query.End, Step: query.Step}
+	value, _, err := client.QueryRange(ctx, expr, r)
+	if err != nil {
+		addGapNotice(frames, fmt.Sprintf("gap detection: uptime query %q failed, assuming the target was up for the whole window", expr))
+		return frames
+	}
+
+	upAtStep, ok := uptimeStepsFromValue(value)
+	if !ok {
+		addGapNotice(frames, fmt.Sprintf("gap detection: uptime metric %q returned no data, assuming the target was up for the whole window", expr))
+		return frames
+	}
+
+	present := sampleTimestamps(primaryFrames)
+
+	var gaps []time.Time
+	for _, step := range stepGrid(query) {
+		if upAtStep[step.Unix()] {
+			continue
+		}
+		if _, ok := present[step.Unix()]; !ok {
+			gaps = append(gaps, step)
+		}
+	}
+
+	if len(gaps) == 0 {
+		return frames
+	}
+
+	addGapNotice(frames, "scrape gap detected: the target appears to have been down for part of this time range")
+	return append(frames, gapAnnotationFrame(query, gaps))
+}
+
+// uptimeExpr picks the PromQL expression used to probe the target's uptime:
+// an explicit override, or "up{job=\"...\"}" derived from the first "job"
+// label found on the primary result, falling back to the bare metric name.
+func uptimeExpr(query *PrometheusQuery, frames data.Frames) string {
+	if query.UptimeMetric != "" {
+		return query.UptimeMetric
+	}
+
+	for _, frame := range frames {
+		if len(frame.Fields) < 2 {
+			continue
+		}
+		if job, ok := frame.Fields[1].Labels["job"]; ok {
+			return fmt.Sprintf("%s{job=%q}", defaultUptimeMetric, job)
+		}
+	}
+
+	return defaultUptimeMetric
+}
+
+// uptimeStepsFromValue flattens an uptime matrix into "was any series up at
+// this step" by unix timestamp. ok is false when there is no data at all,
+// letting the caller distinguish "no data" (assume up) from "has data, all
+// zero" (a real gap).
+func uptimeStepsFromValue(value model.Value) (up map[int64]bool, ok bool) {
+	matrix, isMatrix := value.(model.Matrix)
+	if !isMatrix || len(matrix) == 0 {
+		return nil, false
+	}
+
+	up = make(map[int64]bool)
+	for _, series := range matrix {
+		for _, point := range series.Values {
+			ts := point.Timestamp.Time().Unix()
+			up[ts] = up[ts] || point.Value != 0
+		}
+	}
+
+	return up, true
+}
+
+// stepGrid enumerates the timestamps the primary query was expected to
+// produce a sample for. A non-positive query.Step yields no steps (nil)
+// rather than an endless loop.
+func stepGrid(query *PrometheusQuery) []time.Time {
+	if query.Step <= 0 {
+		return nil
+	}
+
+	var steps []time.Time
+	for t := query.Start; !t.After(query.End); t = t.Add(query.Step) {
+		steps = append(steps, t)
+	}
+	return steps
+}
+
+// sampleTimestamps collects every timestamp any frame has a sample at, as a
+// set keyed by unix seconds, so detectGaps can check each grid step in O(1)
+// instead of rescanning every frame per step.
+func sampleTimestamps(frames data.Frames) map[int64]struct{} {
+	present := make(map[int64]struct{})
+
+	for _, frame := range frames {
+		if len(frame.Fields) == 0 {
+			continue
+		}
+		timeField := frame.Fields[0]
+		for i := 0; i < timeField.Len(); i++ {
+			if t, ok := timeField.At(i).(time.Time); ok {
+				present[t.Unix()] = struct{}{}
+			}
+		}
+	}
+
+	return present
+}
+
+func addGapNotice(frames data.Frames, text string) {
+	if len(frames) == 0 {
+		return
+	}
+	if frames[0].Meta == nil {
+		frames[0].Meta = &data.FrameMeta{}
+	}
+	frames[0].Meta.Notices = append(frames[0].Meta.Notices, data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text:     text,
+	})
+}
+
+// gapAnnotationFrame builds a companion annotation frame marking every
+// detected scrape gap, for panels to render as region/point annotations.
+func gapAnnotationFrame(query *PrometheusQuery, gaps []time.Time) *data.Frame {
+	texts := make([]string, len(gaps))
+	for i := range gaps {
+		texts[i] = "scrape gap"
+	}
+
+	refID := query.RefId + "_gaps"
+	frame := data.NewFrame(refID,
+		data.NewField("time", nil, gaps),
+		data.NewField("text", nil, texts),
+	)
+	frame.RefID = refID
+	frame.Meta = &data.FrameMeta{DataTopic: data.DataTopicAnnotations}
+
+	return frame
+}
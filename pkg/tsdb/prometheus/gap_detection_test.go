@@ -0,0 +1,265 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/client_golang/api"
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// sequencedRoundTripper returns its canned responses in order, one per
+// RoundTrip call, repeating the last one for any call beyond the list -
+// used here so the primary query and the gap-detection uptime query (both
+// issued against the same client) can be mocked independently.
+type sequencedRoundTripper struct {
+	responses [][]byte
+	calls     int
+}
+
+func (rt *sequencedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	idx := rt.calls
+	if idx >= len(rt.responses) {
+		idx = len(rt.responses) - 1
+	}
+	rt.calls++
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(rt.responses[idx])),
+	}, nil
+}
+
+func makeSequencedClient(t *testing.T, responses ...string) apiv1.API {
+	t.Helper()
+
+	raw := make([][]byte, len(responses))
+	for i, r := range responses {
+		raw[i] = []byte(r)
+	}
+
+	client, err := api.NewClient(api.Config{
+		Address:      "http://localhost:9999",
+		RoundTripper: &sequencedRoundTripper{responses: raw},
+	})
+	require.NoError(t, err)
+
+	return apiv1.NewAPI(client)
+}
+
+func TestDetectGaps(t *testing.T) {
+	start := time.Unix(1000, 0)
+	query := PrometheusQuery{
+		RefId:        "A",
+		RangeQuery:   true,
+		Start:        start,
+		End:          start.Add(time.Second * 3),
+		Step:         time.Second,
+		GapDetection: true,
+	}
+
+	t.Run("flags a primary hole that lines up with an uptime=0 step", func(t *testing.T) {
+		primary := `
+		{
+			"status": "success",
+			"data": {
+				"resultType": "matrix",
+				"result": [
+					{
+						"metric": { "job": "prometheus" },
+						"values": [[1000, "1"], [1001, "1"], [1003, "1"]]
+					}
+				]
+			}
+		}
+		`
+
+		uptime := `
+		{
+			"status": "success",
+			"data": {
+				"resultType": "matrix",
+				"result": [
+					{
+						"metric": { "job": "prometheus" },
+						"values": [[1000, "1"], [1001, "1"], [1002, "0"], [1003, "1"]]
+					}
+				]
+			}
+		}
+		`
+
+		client := makeSequencedClient(t, primary, uptime)
+
+		result, err := runQueries(context.Background(), client, []*PrometheusQuery{&query}, nil)
+		require.NoError(t, err)
+
+		dr := result.Responses["A"]
+		require.NoError(t, dr.Error)
+
+		require.NotNil(t, dr.Frames[0].Meta)
+		require.Len(t, dr.Frames[0].Meta.Notices, 1)
+		require.Contains(t, dr.Frames[0].Meta.Notices[0].Text, "scrape gap detected")
+
+		var annotationFrame *data.Frame
+		for _, f := range dr.Frames {
+			if f.RefID == "A_gaps" {
+				annotationFrame = f
+			}
+		}
+		require.NotNil(t, annotationFrame)
+		require.Equal(t, data.DataTopicAnnotations, annotationFrame.Meta.DataTopic)
+		require.Equal(t, 1, annotationFrame.Fields[0].Len())
+		require.Equal(t, start.Add(time.Second*2), annotationFrame.Fields[0].At(0))
+	})
+
+	t.Run("assumes up and only warns when the uptime metric has no data", func(t *testing.T) {
+		primary := `
+		{
+			"status": "success",
+			"data": {
+				"resultType": "matrix",
+				"result": [
+					{
+						"metric": { "job": "prometheus" },
+						"values": [[1000, "1"], [1001, "1"], [1003, "1"]]
+					}
+				]
+			}
+		}
+		`
+
+		emptyUptime := `
+		{
+			"status": "success",
+			"data": {
+				"resultType": "matrix",
+				"result": []
+			}
+		}
+		`
+
+		client := makeSequencedClient(t, primary, emptyUptime)
+
+		result, err := runQueries(context.Background(), client, []*PrometheusQuery{&query}, nil)
+		require.NoError(t, err)
+
+		dr := result.Responses["A"]
+		require.NoError(t, dr.Error)
+
+		require.Len(t, dr.Frames, 1)
+		require.NotNil(t, dr.Frames[0].Meta)
+		require.Len(t, dr.Frames[0].Meta.Notices, 1)
+		require.Contains(t, dr.Frames[0].Meta.Notices[0].Text, "assuming the target was up")
+	})
+
+	t.Run("a stats samples frame does not mask a real gap", func(t *testing.T) {
+		// stats.samples has one entry per evaluation step regardless of
+		// whether the primary series had data there, including step 1002
+		// where the primary series has a hole - if detectGaps judged holes
+		// against the post-attachStats frame slice instead of primaryFrames,
+		// this "samples" frame would make 1002 look present and hide the gap.
+		primaryWithStats := `
+		{
+			"status": "success",
+			"data": {
+				"resultType": "matrix",
+				"result": [
+					{
+						"metric": { "job": "prometheus" },
+						"values": [[1000, "1"], [1001, "1"], [1003, "1"]]
+					}
+				],
+				"stats": {
+					"samplesTotal": 400,
+					"peakSamples": 100,
+					"samples": [[1000, "100"], [1001, "100"], [1002, "100"], [1003, "100"]]
+				}
+			}
+		}
+		`
+
+		uptime := `
+		{
+			"status": "success",
+			"data": {
+				"resultType": "matrix",
+				"result": [
+					{
+						"metric": { "job": "prometheus" },
+						"values": [[1000, "1"], [1001, "1"], [1002, "0"], [1003, "1"]]
+					}
+				]
+			}
+		}
+		`
+
+		statsQuery := query
+		statsQuery.Stats = true
+
+		client, err := newAPIClient("http://localhost:9999", &sequencedRoundTripper{
+			responses: [][]byte{[]byte(primaryWithStats), []byte(uptime)},
+		}, DatasourceSettings{HTTPMethod: HTTPMethodGet})
+		require.NoError(t, err)
+
+		result, err := runQueries(context.Background(), client, []*PrometheusQuery{&statsQuery}, nil)
+		require.NoError(t, err)
+
+		dr := result.Responses["A"]
+		require.NoError(t, dr.Error)
+
+		require.NotNil(t, dr.Frames[0].Meta)
+		require.Contains(t, dr.Frames[0].Meta.Notices[len(dr.Frames[0].Meta.Notices)-1].Text, "scrape gap detected")
+
+		var annotationFrame *data.Frame
+		for _, f := range dr.Frames {
+			if f.RefID == "A_gaps" {
+				annotationFrame = f
+			}
+		}
+		require.NotNil(t, annotationFrame, "stats samples frame masked a real gap")
+		require.Equal(t, 1, annotationFrame.Fields[0].Len())
+		require.Equal(t, start.Add(time.Second*2), annotationFrame.Fields[0].At(0))
+	})
+
+	t.Run("a zero Step is a no-op instead of hanging", func(t *testing.T) {
+		zeroStepQuery := query
+		zeroStepQuery.Step = 0
+
+		primary := `
+		{
+			"status": "success",
+			"data": {
+				"resultType": "matrix",
+				"result": [
+					{ "metric": { "job": "prometheus" }, "values": [[1000, "1"]] }
+				]
+			}
+		}
+		`
+
+		client := makeSequencedClient(t, primary)
+
+		done := make(chan struct{})
+		go func() {
+			result, err := runQueries(context.Background(), client, []*PrometheusQuery{&zeroStepQuery}, nil)
+			require.NoError(t, err)
+			dr := result.Responses["A"]
+			require.NoError(t, dr.Error)
+			require.Len(t, dr.Frames, 1)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("detectGaps did not return for a zero Step; it likely looped forever")
+		}
+	})
+}
@@ -0,0 +1,354 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// prometheusStatsMetaKey is the Frame.Meta.Custom key under which per-query
+// Prometheus execution stats are attached.
+const prometheusStatsMetaKey = "prometheusStats"
+
+// statsCapable is implemented by Prometheus API clients that can return the
+// raw stats=all block alongside a query result. The stock client_golang
+// apiv1.API does not request or expose stats on its own, so newAPIClient
+// wraps it in statsAwareAPI to implement this; detecting it via a type
+// assertion lets runQuery fall back to a stats-less query for any client
+// (e.g. in tests) that doesn't.
+type statsCapable interface {
+	QueryRangeStats(ctx context.Context, query string, r apiv1.Range) (model.Value, *PrometheusStats, apiv1.Warnings, error)
+}
+
+// parseRangeQueryStatsResponse decodes a raw /query_range response body that
+// includes Prometheus's stats=all block. It is shared by the statsCapable
+// implementations in this package so they don't each need to re-derive the
+// wire format.
+func parseRangeQueryStatsResponse(body []byte) (model.Value, *PrometheusStats, apiv1.Warnings, error) {
+	var resp struct {
+		Warnings apiv1.Warnings `json:"warnings,omitempty"`
+		Data     struct {
+			Result model.Matrix     `json:"result"`
+			Stats  *PrometheusStats `json:"stats,omitempty"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid stats query response: %w", err)
+	}
+
+	return resp.Data.Result, resp.Data.Stats, resp.Warnings, nil
+}
+
+// ErrUnexpectedResultType is returned when Prometheus responds with a result
+// shape that does not match what the query asked for, e.g. a vector coming
+// back for a range query. Returning a typed error instead of indexing into
+// the wrong model.Value avoids panics like the one in the Flagger CVE.
+var ErrUnexpectedResultType = errors.New("unexpected result type from Prometheus")
+
+// QueryData is the datasource instance's production entry point: it runs
+// queries against client using the datasource's settings, threading
+// settings.Templates through to runQueries so a query's Expr can invoke
+// them by name.
+func QueryData(ctx context.Context, client apiv1.API, settings DatasourceSettings, queries []*PrometheusQuery) (*backend.QueryDataResponse, error) {
+	return runQueries(ctx, client, queries, settings.Templates)
+}
+
+// runQueries executes every PrometheusQuery against client and assembles the
+// results into a QueryDataResponse keyed by RefId. templates are the named
+// PromQL fragments configured on the datasource, available to each query's
+// Expr via {{template "name" .}}.
+func runQueries(ctx context.Context, client apiv1.API, queries []*PrometheusQuery, templates map[string]string) (*backend.QueryDataResponse, error) {
+	result := backend.NewQueryDataResponse()
+
+	for _, query := range queries {
+		result.Responses[query.RefId] = runQuery(ctx, client, query, templates)
+	}
+
+	return result, nil
+}
+
+func runQuery(ctx context.Context, client apiv1.API, query *PrometheusQuery, templates map[string]string) backend.DataResponse {
+	if err := resolveExpr(query, templates); err != nil {
+		return backend.DataResponse{Error: err}
+	}
+
+	value, stats, warnings, err := executeQuery(ctx, client, query)
+	if err != nil {
+		return backend.DataResponse{Error: err}
+	}
+
+	frames, err := valueToDataFrames(value, query)
+	if err != nil {
+		return backend.DataResponse{Error: err}
+	}
+
+	// primaryFrames is snapshotted before attachStats can splice in a
+	// "<RefId>_samples" frame: Prometheus's per-step stats.samples array has
+	// one entry per evaluation step regardless of whether the primary
+	// series had data there, so detectGaps must judge holes against the
+	// primary result only, not against that frame too.
+	primaryFrames := frames
+
+	addWarningNotices(frames, warnings)
+	frames = attachStats(frames, stats, query)
+
+	if query.GapDetection {
+		frames = detectGaps(ctx, client, query, frames, primaryFrames)
+	}
+
+	return backend.DataResponse{Frames: frames}
+}
+
+// resolveExpr renders query.Expr as a text/template, with query.TemplateVars
+// as the dot value and templates registered as named definitions so Expr can
+// invoke them with {{template "name" .}}. The rendered result replaces
+// query.Expr in place.
+func resolveExpr(query *PrometheusQuery, templates map[string]string) error {
+	tmpl := template.New(query.RefId)
+
+	for name, body := range templates {
+		if _, err := tmpl.New(name).Parse(body); err != nil {
+			return fmt.Errorf("invalid PromQL template %q: %w", name, err)
+		}
+	}
+
+	root, err := tmpl.Parse(query.Expr)
+	if err != nil {
+		return fmt.Errorf("invalid PromQL expression for query %q: %w", query.RefId, err)
+	}
+
+	var buf bytes.Buffer
+	if err := root.Execute(&buf, query.TemplateVars); err != nil {
+		return fmt.Errorf("failed to render PromQL expression for query %q: %w", query.RefId, err)
+	}
+
+	query.Expr = buf.String()
+	return nil
+}
+
+// executeQuery dispatches to the range- or instant-query endpoint depending
+// on query.RangeQuery, using query.Start as the instant-query timestamp. For
+// range queries it additionally requests Prometheus stats when query.Stats is
+// set and client supports it; instant queries never request stats.
+func executeQuery(ctx context.Context, client apiv1.API, query *PrometheusQuery) (model.Value, *PrometheusStats, apiv1.Warnings, error) {
+	if query.RangeQuery {
+		r := apiv1.Range{
+			Start: query.Start,
+			End:   query.End,
+			Step:  query.Step,
+		}
+
+		if query.Stats {
+			if sc, ok := client.(statsCapable); ok {
+				value, stats, warnings, err := sc.QueryRangeStats(ctx, query.Expr, r)
+				return value, stats, warnings, err
+			}
+		}
+
+		value, warnings, err := client.QueryRange(ctx, query.Expr, r)
+		return value, nil, warnings, err
+	}
+
+	value, warnings, err := client.Query(ctx, query.Expr, query.Start)
+	return value, nil, warnings, err
+}
+
+// attachStats records stats as custom metadata on the first frame and, when
+// per-step samples were returned, appends a companion frame (RefId suffixed
+// with "_samples") so panels can plot query cost over time.
+func attachStats(frames data.Frames, stats *PrometheusStats, query *PrometheusQuery) data.Frames {
+	if stats == nil || len(frames) == 0 {
+		return frames
+	}
+
+	if frames[0].Meta == nil {
+		frames[0].Meta = &data.FrameMeta{}
+	}
+	frames[0].Meta.Custom = map[string]interface{}{
+		prometheusStatsMetaKey: stats,
+	}
+
+	if len(stats.Samples) > 0 {
+		frames = append(frames, samplesToDataFrame(stats.Samples, query))
+	}
+
+	return frames
+}
+
+// samplesToDataFrame converts the per-step "samples" series of a stats block
+// into a time/sample-count frame aligned to the query's Start/End/Step grid.
+func samplesToDataFrame(samples []PrometheusStatsSample, query *PrometheusQuery) *data.Frame {
+	times := make([]time.Time, len(samples))
+	counts := make([]int64, len(samples))
+
+	for i, s := range samples {
+		times[i] = s.Timestamp
+		counts[i] = s.Value
+	}
+
+	refID := query.RefId + "_samples"
+	frame := data.NewFrame(refID,
+		data.NewField("time", nil, times),
+		data.NewField("samples", nil, counts),
+	)
+	frame.RefID = refID
+
+	return frame
+}
+
+// valueToDataFrames converts the model.Value Prometheus handed back into
+// data.Frames, enforcing that its concrete type matches what was requested.
+func valueToDataFrames(value model.Value, query *PrometheusQuery) (data.Frames, error) {
+	switch v := value.(type) {
+	case model.Matrix:
+		if !query.RangeQuery {
+			return nil, fmt.Errorf("%w: got a matrix for instant query %q", ErrUnexpectedResultType, query.RefId)
+		}
+		return matrixToDataFrames(v, query), nil
+	case model.Vector:
+		if query.RangeQuery {
+			return nil, fmt.Errorf("%w: got a vector for range query %q", ErrUnexpectedResultType, query.RefId)
+		}
+		return vectorToDataFrames(v, query), nil
+	case *model.Scalar:
+		if query.RangeQuery {
+			return nil, fmt.Errorf("%w: got a scalar for range query %q", ErrUnexpectedResultType, query.RefId)
+		}
+		return scalarToDataFrames(v, query), nil
+	case *model.String:
+		if query.RangeQuery {
+			return nil, fmt.Errorf("%w: got a string for range query %q", ErrUnexpectedResultType, query.RefId)
+		}
+		return stringToDataFrames(v, query), nil
+	default:
+		return nil, fmt.Errorf("%w: got %q for query %q", ErrUnexpectedResultType, value.Type(), query.RefId)
+	}
+}
+
+// matrixToDataFrames converts a range-query result into one data.Frame per
+// series, each carrying a time field and a single value field labelled with
+// the series' metric labels.
+func matrixToDataFrames(matrix model.Matrix, query *PrometheusQuery) data.Frames {
+	frames := make(data.Frames, 0, len(matrix))
+
+	for _, series := range matrix {
+		times := make([]time.Time, 0, len(series.Values))
+		values := make([]float64, 0, len(series.Values))
+
+		for _, point := range series.Values {
+			times = append(times, point.Timestamp.Time())
+			values = append(values, float64(point.Value))
+		}
+
+		timeField := data.NewField("time", nil, times)
+		valueField := data.NewField("value", labelsToTags(series.Metric), values)
+		valueField.Config = &data.FieldConfig{DisplayNameFromDS: formatLegend(series.Metric, query)}
+
+		frame := data.NewFrame(query.RefId, timeField, valueField)
+		frame.RefID = query.RefId
+		frames = append(frames, frame)
+	}
+
+	sortFramesByDisplayName(frames)
+
+	return frames
+}
+
+// vectorToDataFrames converts an instant-query vector result into one
+// data.Frame per series, each holding a single sample at the query
+// timestamp.
+func vectorToDataFrames(vector model.Vector, query *PrometheusQuery) data.Frames {
+	frames := make(data.Frames, 0, len(vector))
+
+	for _, sample := range vector {
+		timeField := data.NewField("time", nil, []time.Time{sample.Timestamp.Time()})
+		valueField := data.NewField("value", labelsToTags(sample.Metric), []float64{float64(sample.Value)})
+		valueField.Config = &data.FieldConfig{DisplayNameFromDS: formatLegend(sample.Metric, query)}
+
+		frame := data.NewFrame(query.RefId, timeField, valueField)
+		frame.RefID = query.RefId
+		frames = append(frames, frame)
+	}
+
+	sortFramesByDisplayName(frames)
+
+	return frames
+}
+
+// scalarToDataFrames converts an instant-query scalar result into a single
+// frame holding the one numeric sample.
+func scalarToDataFrames(scalar *model.Scalar, query *PrometheusQuery) data.Frames {
+	timeField := data.NewField("time", nil, []time.Time{scalar.Timestamp.Time()})
+	valueField := data.NewField("value", nil, []float64{float64(scalar.Value)})
+
+	frame := data.NewFrame(query.RefId, timeField, valueField)
+	frame.RefID = query.RefId
+
+	return data.Frames{frame}
+}
+
+// stringToDataFrames converts an instant-query string result into a single
+// frame holding the one text sample.
+func stringToDataFrames(str *model.String, query *PrometheusQuery) data.Frames {
+	timeField := data.NewField("time", nil, []time.Time{str.Timestamp.Time()})
+	valueField := data.NewField("value", nil, []string{str.Value})
+
+	frame := data.NewFrame(query.RefId, timeField, valueField)
+	frame.RefID = query.RefId
+
+	return data.Frames{frame}
+}
+
+func labelsToTags(metric model.Metric) map[string]string {
+	tags := make(map[string]string, len(metric))
+	for name, val := range metric {
+		tags[string(name)] = string(val)
+	}
+	return tags
+}
+
+func formatLegend(metric model.Metric, query *PrometheusQuery) string {
+	if query.LegendFormat != "" {
+		return query.LegendFormat
+	}
+	return metric.String()
+}
+
+// sortFramesByDisplayName keeps per-series output deterministic, since
+// Prometheus does not guarantee series order.
+func sortFramesByDisplayName(frames data.Frames) {
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i].Fields[1].Config.DisplayNameFromDS < frames[j].Fields[1].Config.DisplayNameFromDS
+	})
+}
+
+// addWarningNotices attaches any warnings returned alongside a Prometheus
+// API response to the first frame of a DataResponse, so the frontend can
+// render them as a panel notice banner.
+func addWarningNotices(frames data.Frames, warnings apiv1.Warnings) {
+	if len(warnings) == 0 || len(frames) == 0 {
+		return
+	}
+
+	if frames[0].Meta == nil {
+		frames[0].Meta = &data.FrameMeta{}
+	}
+
+	for _, warning := range warnings {
+		frames[0].Meta.Notices = append(frames[0].Meta.Notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     warning,
+		})
+	}
+}
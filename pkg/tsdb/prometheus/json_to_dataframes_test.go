@@ -11,9 +11,11 @@ import (
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/grafana-plugin-sdk-go/experimental"
 	"github.com/prometheus/client_golang/api"
 	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
 )
 
@@ -60,6 +62,12 @@ func getRefs(response *backend.QueryDataResponse) []string {
 // we run the mocked query, and extract the DataResponse.
 // we assume and verify that there is exactly one DataResponse returned.
 func getResponse(responseBytes []byte, query PrometheusQuery) (backend.DataResponse, error) {
+	return getResponseWithTemplates(responseBytes, query, nil)
+}
+
+// getResponseWithTemplates is getResponse plus datasource-level PromQL
+// templates, for tests that exercise Expr templating.
+func getResponseWithTemplates(responseBytes []byte, query PrometheusQuery, templates map[string]string) (backend.DataResponse, error) {
 	client, err := makeMockedClient([]byte(responseBytes))
 	if err != nil {
 		return backend.DataResponse{}, nil
@@ -67,7 +75,7 @@ func getResponse(responseBytes []byte, query PrometheusQuery) (backend.DataRespo
 
 	ctx := context.Background()
 
-	result, err := runQueries(ctx, client, []*PrometheusQuery{&query})
+	result, err := runQueries(ctx, client, []*PrometheusQuery{&query}, templates)
 	if err != nil {
 		return backend.DataResponse{}, nil
 	}
@@ -257,4 +265,339 @@ func TestRunQuery(t *testing.T) {
 		require.NoError(t, err)
 	})
 
+	t.Run("parse a matrix response with warnings", func(t *testing.T) {
+		start := time.Unix(1641889530, 0)
+
+		query := PrometheusQuery{
+			RefId:      "A",
+			RangeQuery: true,
+			Start:      start,
+			End:        start.Add(time.Second * 2),
+			Step:       time.Second,
+		}
+
+		response := `
+		{
+			"status": "success",
+			"warnings": ["113 / 612 series returned, results truncated"],
+			"data": {
+				"resultType": "matrix",
+				"result": [
+					{
+						"metric": { "__name__": "go_goroutines", "job": "prometheus" },
+						"values": [
+							[1641889530, "21"],
+							[1641889531, "32"],
+							[1641889532, "43"]
+						]
+					}
+				]
+			}
+		}
+		`
+
+		dr, err := getResponse([]byte(response), query)
+		require.NoError(t, err)
+		require.NoError(t, dr.Error)
+
+		require.Len(t, dr.Frames, 1)
+		require.NotNil(t, dr.Frames[0].Meta)
+		require.Equal(t, []data.Notice{
+			{Severity: data.NoticeSeverityWarning, Text: "113 / 612 series returned, results truncated"},
+		}, dr.Frames[0].Meta.Notices)
+	})
+
+}
+
+func TestRunQuery_InstantResultTypes(t *testing.T) {
+	start := time.Unix(1641889530, 0)
+
+	instantQuery := PrometheusQuery{
+		RefId:      "A",
+		RangeQuery: false,
+		Start:      start,
+	}
+
+	t.Run("parse an instant vector response", func(t *testing.T) {
+		response := `
+		{
+			"status": "success",
+			"data": {
+				"resultType": "vector",
+				"result": [
+					{
+						"metric": { "__name__": "go_goroutines", "job": "prometheus" },
+						"value": [1641889530, "21"]
+					}
+				]
+			}
+		}
+		`
+
+		dr, err := getResponse([]byte(response), instantQuery)
+		require.NoError(t, err)
+		require.NoError(t, dr.Error)
+
+		require.Len(t, dr.Frames, 1)
+		frame := dr.Frames[0]
+		require.Equal(t, "A", frame.RefID)
+		require.Equal(t, 1, frame.Fields[0].Len())
+		require.Equal(t, start, frame.Fields[0].At(0))
+		require.Equal(t, 21.0, frame.Fields[1].At(0))
+		require.Equal(t, map[string]string{"__name__": "go_goroutines", "job": "prometheus"}, map[string]string(frame.Fields[1].Labels))
+	})
+
+	t.Run("parse a scalar response", func(t *testing.T) {
+		response := `
+		{
+			"status": "success",
+			"data": {
+				"resultType": "scalar",
+				"result": [1641889530, "21"]
+			}
+		}
+		`
+
+		dr, err := getResponse([]byte(response), instantQuery)
+		require.NoError(t, err)
+		require.NoError(t, dr.Error)
+
+		require.Len(t, dr.Frames, 1)
+		frame := dr.Frames[0]
+		require.Equal(t, "A", frame.RefID)
+		require.Equal(t, start, frame.Fields[0].At(0))
+		require.Equal(t, 21.0, frame.Fields[1].At(0))
+	})
+
+	t.Run("parse a string response", func(t *testing.T) {
+		response := `
+		{
+			"status": "success",
+			"data": {
+				"resultType": "string",
+				"result": [1641889530, "some string"]
+			}
+		}
+		`
+
+		dr, err := getResponse([]byte(response), instantQuery)
+		require.NoError(t, err)
+		require.NoError(t, dr.Error)
+
+		require.Len(t, dr.Frames, 1)
+		frame := dr.Frames[0]
+		require.Equal(t, "A", frame.RefID)
+		require.Equal(t, start, frame.Fields[0].At(0))
+		require.Equal(t, "some string", frame.Fields[1].At(0))
+	})
+}
+
+func TestRunQuery_MismatchedResultType(t *testing.T) {
+	start := time.Unix(1641889530, 0)
+
+	t.Run("a matrix returned for an instant query is a typed error, not a panic", func(t *testing.T) {
+		query := PrometheusQuery{RefId: "A", RangeQuery: false, Start: start}
+
+		response := `
+		{
+			"status": "success",
+			"data": {
+				"resultType": "matrix",
+				"result": [
+					{ "metric": {}, "values": [[1641889530, "21"]] }
+				]
+			}
+		}
+		`
+
+		dr, err := getResponse([]byte(response), query)
+		require.NoError(t, err)
+		require.ErrorIs(t, dr.Error, ErrUnexpectedResultType)
+	})
+
+	t.Run("a vector returned for a range query is a typed error, not a panic", func(t *testing.T) {
+		query := PrometheusQuery{RefId: "A", RangeQuery: true, Start: start, End: start.Add(time.Second), Step: time.Second}
+
+		response := `
+		{
+			"status": "success",
+			"data": {
+				"resultType": "vector",
+				"result": [
+					{ "metric": {}, "value": [1641889530, "21"] }
+				]
+			}
+		}
+		`
+
+		dr, err := getResponse([]byte(response), query)
+		require.NoError(t, err)
+		require.ErrorIs(t, dr.Error, ErrUnexpectedResultType)
+	})
+}
+
+func TestRunQuery_Templating(t *testing.T) {
+	start := time.Unix(1641889530, 0)
+
+	response := `
+	{
+		"status": "success",
+		"data": {
+			"resultType": "matrix",
+			"result": [
+				{ "metric": {}, "values": [[1641889530, "21"]] }
+			]
+		}
+	}
+	`
+
+	t.Run("renders a named template with the query's variables", func(t *testing.T) {
+		query := PrometheusQuery{
+			RefId:        "A",
+			RangeQuery:   true,
+			Start:        start,
+			End:          start.Add(time.Second),
+			Step:         time.Second,
+			Expr:         `{{template "nodeCpu" .}}`,
+			TemplateVars: map[string]string{"Nodes": "node-a|node-b"},
+		}
+
+		templates := map[string]string{
+			"nodeCpu": `node_cpu_seconds_total{instance=~"{{.Nodes}}"}`,
+		}
+
+		client, err := makeMockedClient([]byte(response))
+		require.NoError(t, err)
+
+		result, err := runQueries(context.Background(), client, []*PrometheusQuery{&query}, templates)
+		require.NoError(t, err)
+
+		dr := result.Responses["A"]
+		require.NoError(t, dr.Error)
+		require.Equal(t, `node_cpu_seconds_total{instance=~"node-a|node-b"}`, query.Expr)
+	})
+
+	t.Run("fails only the offending query when the named template is missing", func(t *testing.T) {
+		query := PrometheusQuery{
+			RefId:      "A",
+			RangeQuery: true,
+			Start:      start,
+			End:        start.Add(time.Second),
+			Step:       time.Second,
+			Expr:       `{{template "missing" .}}`,
+		}
+
+		dr, err := getResponseWithTemplates([]byte(response), query, nil)
+		require.NoError(t, err)
+		require.Error(t, dr.Error)
+	})
+
+	t.Run("QueryData threads a datasource's configured Templates into the query", func(t *testing.T) {
+		query := PrometheusQuery{
+			RefId:        "A",
+			RangeQuery:   true,
+			Start:        start,
+			End:          start.Add(time.Second),
+			Step:         time.Second,
+			Expr:         `{{template "nodeCpu" .}}`,
+			TemplateVars: map[string]string{"Nodes": "node-a|node-b"},
+		}
+
+		settings := DatasourceSettings{
+			Templates: map[string]string{
+				"nodeCpu": `node_cpu_seconds_total{instance=~"{{.Nodes}}"}`,
+			},
+		}
+
+		client, err := makeMockedClient([]byte(response))
+		require.NoError(t, err)
+
+		result, err := QueryData(context.Background(), client, settings, []*PrometheusQuery{&query})
+		require.NoError(t, err)
+
+		dr := result.Responses["A"]
+		require.NoError(t, dr.Error)
+		require.Equal(t, `node_cpu_seconds_total{instance=~"node-a|node-b"}`, query.Expr)
+	})
+}
+
+// statsMockClient is a statsCapable apiv1.API whose QueryRangeStats decodes
+// a canned response, for tests that don't go through a real Prometheus
+// server's stats=all support.
+type statsMockClient struct {
+	apiv1.API
+	responseBytes []byte
+}
+
+func (c *statsMockClient) QueryRangeStats(ctx context.Context, query string, r apiv1.Range) (model.Value, *PrometheusStats, apiv1.Warnings, error) {
+	return parseRangeQueryStatsResponse(c.responseBytes)
+}
+
+func TestRunQuery_Stats(t *testing.T) {
+	start := time.Unix(1641889530, 0)
+
+	query := PrometheusQuery{
+		RefId:      "A",
+		RangeQuery: true,
+		Start:      start,
+		End:        start.Add(time.Second * 2),
+		Step:       time.Second,
+		Stats:      true,
+	}
+
+	response := `
+	{
+		"status": "success",
+		"data": {
+			"resultType": "matrix",
+			"result": [
+				{
+					"metric": { "__name__": "go_goroutines", "job": "prometheus" },
+					"values": [
+						[1641889530, "21"],
+						[1641889531, "32"],
+						[1641889532, "43"]
+					]
+				}
+			],
+			"stats": {
+				"samplesTotal": 300,
+				"peakSamples": 120,
+				"samples": [
+					[1641889530, "100"],
+					[1641889531, "100"],
+					[1641889532, "100"]
+				]
+			}
+		}
+	}
+	`
+
+	client := &statsMockClient{responseBytes: []byte(response)}
+
+	ctx := context.Background()
+	result, err := runQueries(ctx, client, []*PrometheusQuery{&query}, nil)
+	require.NoError(t, err)
+
+	dr, found := result.Responses["A"]
+	require.True(t, found)
+	require.NoError(t, dr.Error)
+
+	require.Len(t, dr.Frames, 2)
+	require.NotNil(t, dr.Frames[0].Meta)
+	require.Equal(t, map[string]interface{}{
+		prometheusStatsMetaKey: &PrometheusStats{
+			SamplesTotal: 300,
+			PeakSamples:  120,
+			Samples: []PrometheusStatsSample{
+				{Timestamp: time.Unix(1641889530, 0), Value: 100},
+				{Timestamp: time.Unix(1641889531, 0), Value: 100},
+				{Timestamp: time.Unix(1641889532, 0), Value: 100},
+			},
+		},
+	}, dr.Frames[0].Meta.Custom)
+
+	samplesFrame := dr.Frames[1]
+	require.Equal(t, "A_samples", samplesFrame.RefID)
+	require.Equal(t, 3, samplesFrame.Fields[0].Len())
 }
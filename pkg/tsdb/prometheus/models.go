@@ -0,0 +1,113 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// PrometheusQuery is the parsed representation of a single query target
+// inside a Grafana panel, ready to be translated into calls against the
+// Prometheus HTTP API.
+type PrometheusQuery struct {
+	Expr         string
+	Step         time.Duration
+	LegendFormat string
+	Start        time.Time
+	End          time.Time
+	RefId        string
+
+	// RangeQuery selects the /query_range endpoint. When false, an instant
+	// query against /query is issued instead, using Start as the query time.
+	RangeQuery bool
+
+	// TemplateVars supplies the data made available (as ".") while rendering
+	// Expr as a text/template, so panel queries can invoke the named
+	// fragments from the datasource's Templates.
+	TemplateVars map[string]string
+
+	// Stats requests Prometheus's stats=all block (samples touched) for this
+	// query, surfaced as custom frame metadata by runQueries. It only applies
+	// to range queries; instant queries ignore it.
+	Stats bool
+
+	// GapDetection cross-checks the query's results against an uptime
+	// metric over the same window and annotates any scrape gaps found.
+	GapDetection bool
+
+	// UptimeMetric overrides the PromQL expression GapDetection uses to
+	// probe the target's uptime. When empty, it is derived from the
+	// primary result's "job" label, falling back to the bare "up" metric.
+	UptimeMetric string
+}
+
+// PrometheusStats mirrors the "stats=all" block Prometheus attaches to
+// /query_range responses.
+type PrometheusStats struct {
+	SamplesTotal int64                   `json:"samplesTotal"`
+	PeakSamples  int64                   `json:"peakSamples"`
+	Samples      []PrometheusStatsSample `json:"samples,omitempty"`
+}
+
+// PrometheusStatsSample is one point of the optional per-step "samples"
+// series in a stats block.
+type PrometheusStatsSample struct {
+	Timestamp time.Time
+	Value     int64
+}
+
+// UnmarshalJSON decodes a stats sample from its [timestamp, "count"] wire
+// format, mirroring how model.SamplePair decodes matrix/vector values.
+func (s *PrometheusStatsSample) UnmarshalJSON(b []byte) error {
+	var pair [2]interface{}
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+
+	ts, ok := pair[0].(float64)
+	if !ok {
+		return fmt.Errorf("invalid timestamp in stats sample: %v", pair[0])
+	}
+	s.Timestamp = time.Unix(int64(ts), 0)
+
+	countStr, ok := pair[1].(string)
+	if !ok {
+		return fmt.Errorf("invalid sample count in stats sample: %v", pair[1])
+	}
+
+	count, err := strconv.ParseInt(countStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sample count in stats sample: %w", err)
+	}
+
+	s.Value = count
+	return nil
+}
+
+// DatasourceSettings holds the parsed jsonData for a Prometheus datasource.
+type DatasourceSettings struct {
+	// Templates are named, reusable PromQL fragments: each value is parsed as
+	// a text/template body registered under its map key, invoked from a
+	// query's Expr with {{template "name" .}}.
+	Templates map[string]string
+
+	// HTTPMethod selects how queries are sent to Prometheus. Defaults to
+	// HTTPMethodAuto when empty.
+	HTTPMethod HTTPMethod
+}
+
+// HTTPMethod selects how Prometheus API requests are issued.
+type HTTPMethod string
+
+const (
+	// HTTPMethodGet always sends requests as GET, with parameters in the
+	// URL's query string.
+	HTTPMethodGet HTTPMethod = "GET"
+	// HTTPMethodPost always sends requests as POST, with parameters in an
+	// application/x-www-form-urlencoded body.
+	HTTPMethodPost HTTPMethod = "POST"
+	// HTTPMethodAuto tries POST first and falls back to GET if the upstream
+	// rejects it, caching the outcome for subsequent requests.
+	HTTPMethodAuto HTTPMethod = "AUTO"
+)